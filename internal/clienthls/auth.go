@@ -0,0 +1,96 @@
+package clienthls
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+// how long the result of a webhook call is cached for a given set of
+// credentials, so that a slow viewer doesn't trigger a webhook call
+// per segment.
+const externalAuthCacheDuration = 5 * time.Second
+
+// externalAuthHTTPClient is used for webhook calls: runRequestHandler
+// spawns one goroutine per HTTP request, so a client with no timeout
+// would let a slow or unresponsive webhook hang those goroutines
+// indefinitely.
+var externalAuthHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type externalAuthCacheEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+// externalAuthRequest is the JSON body POSTed to the external
+// authentication webhook.
+type externalAuthRequest struct {
+	IP       string `json:"ip"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Path     string `json:"path"`
+	Action   string `json:"action"`
+	Protocol string `json:"protocol"`
+}
+
+// externalAuthenticate POSTs the request details to the given webhook
+// URL and returns whether it replied with a 2xx status code. Results
+// are cached briefly per set of credentials: caching by remote IP
+// alone would let one viewer's pass/fail leak onto every other viewer
+// sharing the same IP (NAT, a proxy, or a mobile carrier).
+func (c *Client) externalAuthenticate(url string, req *http.Request) bool {
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	cacheKey := ip + "|" + req.Header.Get("Authorization")
+
+	c.authMutex.Lock()
+	if entry, ok := c.authCache[cacheKey]; ok && time.Now().Before(entry.expires) {
+		c.authMutex.Unlock()
+		return entry.ok
+	}
+	c.authMutex.Unlock()
+
+	ok := c.doExternalAuthRequest(url, ip, req)
+
+	c.authMutex.Lock()
+	if c.authCache == nil {
+		c.authCache = make(map[string]externalAuthCacheEntry)
+	}
+	c.authCache[cacheKey] = externalAuthCacheEntry{
+		ok:      ok,
+		expires: time.Now().Add(externalAuthCacheDuration),
+	}
+	c.authMutex.Unlock()
+
+	return ok
+}
+
+func (c *Client) doExternalAuthRequest(url string, ip string, req *http.Request) bool {
+	user, pass, _ := req.BasicAuth()
+
+	body, err := json.Marshal(externalAuthRequest{
+		IP:       ip,
+		User:     user,
+		Password: pass,
+		Path:     c.pathName,
+		Action:   "read",
+		Protocol: "hls",
+	})
+	if err != nil {
+		return false
+	}
+
+	res, err := externalAuthHTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.log(logger.Warn, "external authentication request failed: %s", err)
+		return false
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode >= 200 && res.StatusCode < 300
+}
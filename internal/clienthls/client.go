@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,6 +35,20 @@ const (
 	segmentMinAUCount    = 100
 	closeCheckPeriod     = 1 * time.Second
 	closeAfterInactivity = 60 * time.Second
+
+	// how long a blocking playlist/part request is allowed to wait
+	// before the reload/preload-hint it asked for becomes available.
+	hlsBlockingRequestTimeout = 10 * time.Second
+)
+
+// Variant is the format used to serve a HLS stream.
+type Variant int
+
+// supported variants.
+const (
+	VariantMPEGTS Variant = iota
+	VariantFMP4
+	VariantLowLatency
 )
 
 const index = `<!DOCTYPE html>
@@ -120,6 +136,21 @@ type Parent interface {
 type Client struct {
 	hlsSegmentCount    int
 	hlsSegmentDuration time.Duration
+	hlsVariant         Variant
+	hlsPartDuration    time.Duration
+	hlsSegmentMaxSize  uint64
+	hlsDirectory       string
+	// alwaysRemux, when true, keeps this Client (and therefore its HLS
+	// muxer) running for the whole lifetime of the path instead of
+	// closing it after closeAfterInactivity. It is the caller's
+	// responsibility to instantiate the Client as soon as the path is
+	// ready to publish (rather than lazily on the first HLS request)
+	// and to hand every subsequent viewer of the path to this same
+	// Client instance via OnRequest, so that segments already exist
+	// before the first viewer shows up; this package only honors the
+	// flag once it has been set, it does not decide when to create or
+	// reuse a Client.
+	alwaysRemux bool
 	readBufferCount    int
 	wg                 *sync.WaitGroup
 	stats              *stats.Stats
@@ -129,11 +160,18 @@ type Client struct {
 
 	path            client.Path
 	ringBuffer      *ringbuffer.RingBuffer
-	tsQueue         []*tsFile
-	tsByName        map[string]*tsFile
+	initSegment     []byte
+	tsQueue         []segment
+	tsByName        map[string]segment
 	tsDeleteCount   int
 	tsMutex         sync.Mutex
+	tsCond          *sync.Cond
 	lastRequestTime int64
+	authMutex       sync.Mutex
+	authCache       map[string]externalAuthCacheEntry
+	bytesSent       int64
+	framesPushed    int64
+	framesPulled    int64
 
 	// in
 	request   chan serverhls.Request
@@ -144,6 +182,11 @@ type Client struct {
 func New(
 	hlsSegmentCount int,
 	hlsSegmentDuration time.Duration,
+	hlsVariant Variant,
+	hlsPartDuration time.Duration,
+	hlsSegmentMaxSize uint64,
+	hlsDirectory string,
+	alwaysRemux bool,
 	readBufferCount int,
 	wg *sync.WaitGroup,
 	stats *stats.Stats,
@@ -154,6 +197,11 @@ func New(
 	c := &Client{
 		hlsSegmentCount:    hlsSegmentCount,
 		hlsSegmentDuration: hlsSegmentDuration,
+		hlsVariant:         hlsVariant,
+		hlsPartDuration:    hlsPartDuration,
+		hlsSegmentMaxSize:  hlsSegmentMaxSize,
+		hlsDirectory:       hlsDirectory,
+		alwaysRemux:        alwaysRemux,
 		readBufferCount:    readBufferCount,
 		wg:                 wg,
 		stats:              stats,
@@ -161,13 +209,19 @@ func New(
 		pathMan:            pathMan,
 		parent:             parent,
 		lastRequestTime:    time.Now().Unix(),
-		tsByName:           make(map[string]*tsFile),
+		tsByName:           make(map[string]segment),
 		request:            make(chan serverhls.Request),
 		terminate:          make(chan struct{}),
 	}
+	c.tsCond = sync.NewCond(&c.tsMutex)
 
 	atomic.AddInt64(c.stats.CountClients, 1)
-	c.log(logger.Info, "connected (HLS)")
+	atomic.AddInt64(c.stats.CountMuxersHLS, 1)
+	if alwaysRemux {
+		c.log(logger.Info, "remuxing (HLS, always-on)")
+	} else {
+		c.log(logger.Info, "connected (HLS)")
+	}
 
 	c.wg.Add(1)
 	go c.run()
@@ -178,6 +232,7 @@ func New(
 // Close closes a Client.
 func (c *Client) Close() {
 	atomic.AddInt64(c.stats.CountClients, -1)
+	atomic.AddInt64(c.stats.CountMuxersHLS, -1)
 	close(c.terminate)
 }
 
@@ -196,6 +251,24 @@ func (c *Client) PathName() string {
 	return c.pathName
 }
 
+// BytesSent returns the total number of bytes served by this muxer,
+// for use by the metrics/API subsystem.
+func (c *Client) BytesSent() int64 {
+	return atomic.LoadInt64(&c.bytesSent)
+}
+
+// LastRequestTime returns the time of the last served HTTP request.
+func (c *Client) LastRequestTime() time.Time {
+	return time.Unix(atomic.LoadInt64(&c.lastRequestTime), 0)
+}
+
+// QueueDepth returns the number of frames that have been pushed onto
+// the ring buffer but not yet consumed by the muxer, so that a slow
+// publisher (or a muxer that is falling behind) can be diagnosed.
+func (c *Client) QueueDepth() int64 {
+	return atomic.LoadInt64(&c.framesPushed) - atomic.LoadInt64(&c.framesPulled)
+}
+
 func (c *Client) run() {
 	defer c.wg.Done()
 	defer c.log(logger.Info, "disconnected")
@@ -205,6 +278,7 @@ func (c *Client) run() {
 	var h264PPS []byte
 	var h264Decoder *rtph264.Decoder
 	var audioTrack *gortsplib.Track
+	var aacConfigBytes []byte
 	var aacConfig rtpaac.MPEG4AudioConfig
 	var aacDecoder *rtpaac.Decoder
 
@@ -244,6 +318,7 @@ func (c *Client) run() {
 				if err != nil {
 					return err
 				}
+				aacConfigBytes = byts
 
 				err = aacConfig.Decode(byts)
 				if err != nil {
@@ -283,7 +358,13 @@ func (c *Client) run() {
 		return
 	}
 
-	curTSFile := newTSFile(videoTrack, audioTrack)
+	if c.hlsVariant != VariantMPEGTS {
+		c.initSegment = buildInitSegment(
+			videoTrack != nil, h264SPS, h264PPS,
+			audioTrack != nil, aacConfigBytes, aacConfig.SampleRate, aacConfig.ChannelCount)
+	}
+
+	curTSFile := c.newSegment(videoTrack, audioTrack)
 	c.tsByName[curTSFile.Name()] = curTSFile
 	c.tsQueue = append(c.tsQueue, curTSFile)
 
@@ -320,6 +401,7 @@ func (c *Client) run() {
 				if !ok {
 					return fmt.Errorf("terminated")
 				}
+				atomic.AddInt64(&c.framesPulled, 1)
 				pair := data.(trackIDPayloadPair)
 
 				if videoTrack != nil && pair.trackID == videoTrack.ID {
@@ -363,26 +445,26 @@ func (c *Client) run() {
 						}()
 
 						if isIDR {
-							if curTSFile.firstPacketWritten &&
-								time.Since(curTSFile.firstPacketWrittenTime) >= c.hlsSegmentDuration {
-								if curTSFile != nil {
-									curTSFile.Close()
-								}
+							if curTSFile.HasFirstPacketWritten() &&
+								time.Since(curTSFile.FirstPacketWrittenTime()) >= c.hlsSegmentDuration {
+								curTSFile.Close()
 
-								curTSFile = newTSFile(videoTrack, audioTrack)
+								curTSFile = c.newSegment(videoTrack, audioTrack)
 								c.tsMutex.Lock()
 								c.tsByName[curTSFile.Name()] = curTSFile
 								c.tsQueue = append(c.tsQueue, curTSFile)
 								if len(c.tsQueue) > c.hlsSegmentCount {
+									c.tsQueue[0].RemoveDisk()
 									delete(c.tsByName, c.tsQueue[0].Name())
 									c.tsQueue = c.tsQueue[1:]
 									c.tsDeleteCount++
 								}
+								c.tsCond.Broadcast()
 								c.tsMutex.Unlock()
 							}
 
 						} else {
-							if !curTSFile.firstPacketWritten {
+							if !curTSFile.HasFirstPacketWritten() {
 								continue
 							}
 						}
@@ -410,28 +492,28 @@ func (c *Client) run() {
 					}
 
 					if videoTrack == nil {
-						if curTSFile.firstPacketWritten &&
-							(time.Since(curTSFile.firstPacketWrittenTime) >= c.hlsSegmentDuration &&
+						if curTSFile.HasFirstPacketWritten() &&
+							(time.Since(curTSFile.FirstPacketWrittenTime()) >= c.hlsSegmentDuration &&
 								audioAUCount >= segmentMinAUCount) {
 
-							if curTSFile != nil {
-								curTSFile.Close()
-							}
+							curTSFile.Close()
 
 							audioAUCount = 0
-							curTSFile = newTSFile(videoTrack, audioTrack)
+							curTSFile = c.newSegment(videoTrack, audioTrack)
 							c.tsMutex.Lock()
 							c.tsByName[curTSFile.Name()] = curTSFile
 							c.tsQueue = append(c.tsQueue, curTSFile)
 							if len(c.tsQueue) > c.hlsSegmentCount {
+								c.tsQueue[0].RemoveDisk()
 								delete(c.tsByName, c.tsQueue[0].Name())
 								c.tsQueue = c.tsQueue[1:]
 								c.tsDeleteCount++
 							}
+							c.tsCond.Broadcast()
 							c.tsMutex.Unlock()
 						}
 					} else {
-						if !curTSFile.firstPacketWritten {
+						if !curTSFile.HasFirstPacketWritten() {
 							continue
 						}
 					}
@@ -462,7 +544,7 @@ func (c *Client) run() {
 		select {
 		case <-closeCheckTicker.C:
 			t := time.Unix(atomic.LoadInt64(&c.lastRequestTime), 0)
-			if time.Since(t) >= closeAfterInactivity {
+			if !c.alwaysRemux && time.Since(t) >= closeAfterInactivity {
 				c.log(logger.Info, "closing due to inactivity")
 
 				c.ringBuffer.Close()
@@ -503,13 +585,33 @@ func (c *Client) run() {
 func (c *Client) runRequestHandler(done chan struct{}) {
 	defer close(done)
 
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	for preq := range c.request {
 		req := preq
 
-		atomic.StoreInt64(&c.lastRequestTime, time.Now().Unix())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.handleRequest(req)
+		}()
+	}
+}
+
+func (c *Client) handleRequest(req serverhls.Request) {
+	atomic.StoreInt64(&c.lastRequestTime, time.Now().Unix())
 
-		conf := c.path.Conf()
+	conf := c.path.Conf()
 
+	if conf.ExternalAuthenticationURL != "" {
+		if !c.externalAuthenticate(conf.ExternalAuthenticationURL, req.Req) {
+			c.log(logger.Info, "ERR: external authentication failed")
+			req.W.WriteHeader(http.StatusUnauthorized)
+			req.Res <- nil
+			return
+		}
+	} else {
 		if conf.ReadIpsParsed != nil {
 			tmp, _, _ := net.SplitHostPort(req.Req.RemoteAddr)
 			ip := net.ParseIP(tmp)
@@ -517,7 +619,7 @@ func (c *Client) runRequestHandler(done chan struct{}) {
 				c.log(logger.Info, "ERR: ip '%s' not allowed", ip)
 				req.W.WriteHeader(http.StatusUnauthorized)
 				req.Res <- nil
-				continue
+				return
 			}
 		}
 
@@ -527,57 +629,222 @@ func (c *Client) runRequestHandler(done chan struct{}) {
 				req.W.Header().Set("WWW-Authenticate", `Basic realm="rtsp-simple-server"`)
 				req.W.WriteHeader(http.StatusUnauthorized)
 				req.Res <- nil
-				continue
+				return
 			}
 		}
+	}
 
-		switch {
-		case req.Subpath == "stream.m3u8":
-			func() {
-				c.tsMutex.Lock()
-				defer c.tsMutex.Unlock()
+	switch {
+	case req.Subpath == "stream.m3u8":
+		c.handlePlaylistRequest(req)
 
-				if len(c.tsQueue) == 0 {
-					req.W.WriteHeader(http.StatusNotFound)
-					req.Res <- nil
-					return
-				}
+	case strings.HasSuffix(req.Subpath, ".ts") || strings.HasSuffix(req.Subpath, ".mp4"):
+		c.handleSegmentRequest(req)
 
-				cnt := "#EXTM3U\n"
-				cnt += "#EXT-X-VERSION:3\n"
-				cnt += "#EXT-X-ALLOW-CACHE:NO\n"
-				cnt += "#EXT-X-TARGETDURATION:10\n"
-				cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(c.tsDeleteCount), 10) + "\n"
-				for _, f := range c.tsQueue {
-					cnt += "#EXTINF:10,\n"
-					cnt += f.Name() + ".ts\n"
-				}
-				req.Res <- bytes.NewReader([]byte(cnt))
-			}()
+	case req.Subpath == "":
+		req.Res <- bytes.NewReader([]byte(index))
 
-		case strings.HasSuffix(req.Subpath, ".ts"):
-			base := strings.TrimSuffix(req.Subpath, ".ts")
+	default:
+		req.W.WriteHeader(http.StatusNotFound)
+		req.Res <- nil
+	}
+}
 
-			c.tsMutex.Lock()
-			f, ok := c.tsByName[base]
-			c.tsMutex.Unlock()
+// handlePlaylistRequest serves stream.m3u8, optionally blocking until the
+// media sequence / part requested through _HLS_msn / _HLS_part becomes
+// available, per the LL-HLS blocking playlist reload spec.
+func (c *Client) handlePlaylistRequest(req serverhls.Request) {
+	msn, hasMSN := parseQueryInt(req.Req, "_HLS_msn")
+	part, hasPart := parseQueryInt(req.Req, "_HLS_part")
 
-			if !ok {
-				req.W.WriteHeader(http.StatusNotFound)
-				req.Res <- nil
-				continue
-			}
+	c.tsMutex.Lock()
+	defer c.tsMutex.Unlock()
 
-			req.Res <- f.buf.NewReader()
+	if c.hlsVariant == VariantLowLatency && (hasMSN || hasPart) {
+		c.waitReload(msn, part, hasPart, time.Now().Add(hlsBlockingRequestTimeout))
+	}
 
-		case req.Subpath == "":
-			req.Res <- bytes.NewReader([]byte(index))
+	if len(c.tsQueue) == 0 {
+		req.W.WriteHeader(http.StatusNotFound)
+		req.Res <- nil
+		return
+	}
 
-		default:
-			req.W.WriteHeader(http.StatusNotFound)
-			req.Res <- nil
+	req.Res <- c.countReader(bytes.NewReader([]byte(c.generatePlaylist())))
+}
+
+// reloadSatisfied returns whether the segment (and, for low-latency,
+// the part) requested through _HLS_msn / _HLS_part has been generated.
+func (c *Client) reloadSatisfied(msn int, part int, hasPart bool) bool {
+	lastMSN := c.tsDeleteCount + len(c.tsQueue) - 1
+	if lastMSN < msn {
+		return false
+	}
+	if lastMSN > msn {
+		return true
+	}
+	if !hasPart {
+		return true
+	}
+	last := c.tsQueue[len(c.tsQueue)-1]
+	fp, ok := last.(*fmp4Segment)
+	return ok && fp.PartCount() > part
+}
+
+// waitReload blocks, with c.tsMutex held, until reloadSatisfied(msn,
+// part, hasPart) becomes true or deadline passes. A single timer wakes
+// the wait up at the deadline; it is always stopped before returning,
+// so no goroutine is left running past reloadSatisfied becoming true.
+func (c *Client) waitReload(msn int, part int, hasPart bool, deadline time.Time) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.tsMutex.Lock()
+		c.tsCond.Broadcast()
+		c.tsMutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for !c.reloadSatisfied(msn, part, hasPart) && time.Now().Before(deadline) {
+		c.tsCond.Wait()
+	}
+}
+
+func parseQueryInt(req *http.Request, key string) (int, bool) {
+	v := req.URL.Query().Get(key)
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// generatePlaylist must be called with c.tsMutex held.
+func (c *Client) generatePlaylist() string {
+	if c.hlsVariant == VariantLowLatency {
+		return c.generateLowLatencyPlaylist()
+	}
+
+	cnt := "#EXTM3U\n"
+	cnt += "#EXT-X-VERSION:3\n"
+	cnt += "#EXT-X-ALLOW-CACHE:NO\n"
+	cnt += "#EXT-X-TARGETDURATION:10\n"
+	cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(c.tsDeleteCount), 10) + "\n"
+	ext := ".ts"
+	if c.hlsVariant == VariantFMP4 {
+		ext = ".mp4"
+		cnt += "#EXT-X-MAP:URI=\"init.mp4\"\n"
+	}
+	for _, f := range c.tsQueue {
+		cnt += "#EXTINF:10,\n"
+		cnt += f.Name() + ext + "\n"
+	}
+	return cnt
+}
+
+func (c *Client) generateLowLatencyPlaylist() string {
+	partTarget := c.hlsPartDuration.Seconds()
+
+	cnt := "#EXTM3U\n"
+	cnt += "#EXT-X-VERSION:9\n"
+	cnt += "#EXT-X-TARGETDURATION:10\n"
+	cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(c.tsDeleteCount), 10) + "\n"
+	cnt += "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=" +
+		strconv.FormatFloat(3*partTarget, 'f', -1, 64) + "\n"
+	cnt += "#EXT-X-PART-INF:PART-TARGET=" + strconv.FormatFloat(partTarget, 'f', -1, 64) + "\n"
+	cnt += "#EXT-X-MAP:URI=\"init.mp4\"\n"
+
+	for i, f := range c.tsQueue {
+		fp, ok := f.(*fmp4Segment)
+		if !ok {
+			continue
 		}
+
+		isLast := i == len(c.tsQueue)-1
+		for j, d := range fp.PartDurations() {
+			cnt += "#EXT-X-PART:DURATION=" + strconv.FormatFloat(d.Seconds(), 'f', -1, 64) +
+				",URI=\"" + f.Name() + ".part" + strconv.Itoa(j) + ".mp4\"\n"
+			_ = isLast
+		}
+
+		cnt += "#EXTINF:10,\n"
+		cnt += f.Name() + ".mp4\n"
+	}
+
+	if last, ok := c.tsQueue[len(c.tsQueue)-1].(*fmp4Segment); ok {
+		nextPart := last.PartCount()
+		cnt += "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + last.Name() + ".part" +
+			strconv.Itoa(nextPart) + ".mp4\"\n"
+	}
+
+	return cnt
+}
+
+func (c *Client) handleSegmentRequest(req serverhls.Request) {
+	if req.Subpath == "init.mp4" {
+		req.Res <- c.countReader(bytes.NewReader(c.initSegment))
+		return
+	}
+
+	// the segment name is the leading dot-separated component, e.g.
+	// "123" in both "123.ts" and "123.part4.mp4".
+	base := strings.SplitN(req.Subpath, ".", 2)[0]
+
+	c.tsMutex.Lock()
+	f, ok := c.tsByName[base]
+	c.tsMutex.Unlock()
+
+	if !ok {
+		req.W.WriteHeader(http.StatusNotFound)
+		req.Res <- nil
+		return
+	}
+
+	// segments (or, for fMP4, individual parts) stored on disk are
+	// served directly, so that Range requests work and large
+	// DVR-style windows don't have to be pinned in RAM.
+	if diskPath, ok := f.DiskPath(req.Subpath); ok {
+		http.ServeFile(c.countResponseWriter(req.W), req.Req, diskPath)
+		req.Res <- nil
+		return
+	}
+
+	r, ok := f.Reader(req.Subpath)
+	if !ok {
+		req.W.WriteHeader(http.StatusNotFound)
+		req.Res <- nil
+		return
+	}
+
+	req.Res <- c.countReader(r)
+}
+
+// newSegment allocates a segment (tsFile or fmp4Segment) according to
+// the configured HLS variant.
+func (c *Client) newSegment(videoTrack *gortsplib.Track, audioTrack *gortsplib.Track) segment {
+	atomic.AddInt64(c.stats.SegmentsGeneratedHLS, 1)
+
+	dir := c.segmentDirectory()
+	if c.hlsVariant == VariantMPEGTS {
+		return newTSFile(videoTrack, audioTrack, dir, c.hlsSegmentMaxSize)
+	}
+	return newFMP4Segment(videoTrack, audioTrack, dir, c.hlsPartDuration, c.hlsSegmentMaxSize)
+}
+
+// segmentDirectory returns the directory new segments must be written
+// to, creating it if needed, or "" if hlsDirectory is not configured.
+func (c *Client) segmentDirectory() string {
+	if c.hlsDirectory == "" {
+		return ""
+	}
+
+	dir := filepath.Join(c.hlsDirectory, c.pathName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		c.log(logger.Warn, "unable to create HLS segment directory: %s", err)
+		return ""
 	}
+	return dir
 }
 
 // OnRequest is called by clientman.ClientMan.
@@ -595,6 +862,7 @@ func (c *Client) Authenticate(authMethods []headers.AuthMethod,
 // OnFrame implements path.Reader.
 func (c *Client) OnFrame(trackID int, streamType gortsplib.StreamType, payload []byte) {
 	if streamType == gortsplib.StreamTypeRTP {
+		atomic.AddInt64(&c.framesPushed, 1)
 		c.ringBuffer.Push(trackIDPayloadPair{trackID, payload})
 	}
 }
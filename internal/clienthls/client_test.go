@@ -0,0 +1,31 @@
+package clienthls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadSatisfied(t *testing.T) {
+	seg0 := newFMP4Segment(nil, nil, "", time.Second, 0)
+	seg1 := newFMP4Segment(nil, nil, "", time.Second, 0)
+	seg1.parts = append(seg1.parts, &fmp4Part{}, &fmp4Part{})
+
+	c := &Client{
+		tsQueue:       []segment{seg0, seg1},
+		tsDeleteCount: 5,
+	}
+
+	// lastMSN = tsDeleteCount + len(tsQueue) - 1 = 6
+	if !c.reloadSatisfied(5, 0, false) {
+		t.Fatal("an older segment should already be satisfied")
+	}
+	if c.reloadSatisfied(7, 0, false) {
+		t.Fatal("a segment that hasn't been generated yet should not be satisfied")
+	}
+	if !c.reloadSatisfied(6, 0, true) {
+		t.Fatal("an available part of the last segment should be satisfied")
+	}
+	if c.reloadSatisfied(6, 5, true) {
+		t.Fatal("a part beyond what has been generated should not be satisfied")
+	}
+}
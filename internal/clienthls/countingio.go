@@ -0,0 +1,50 @@
+package clienthls
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// countingReader wraps an io.Reader, atomically adding every byte read
+// to the owning Client's bytesSent counter and to the global
+// stats.BytesSentHLS counter, so that HLS bandwidth can be monitored
+// per-path and globally.
+type countingReader struct {
+	r io.Reader
+	c *Client
+}
+
+func (c *Client) countReader(r io.Reader) io.Reader {
+	return &countingReader{r: r, c: c}
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&cr.c.bytesSent, int64(n))
+		atomic.AddInt64(cr.c.stats.BytesSentHLS, int64(n))
+	}
+	return n, err
+}
+
+// countingResponseWriter wraps a http.ResponseWriter, used when a
+// segment is served directly from disk with http.ServeFile, which
+// writes to the ResponseWriter instead of returning an io.Reader.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	c *Client
+}
+
+func (c *Client) countResponseWriter(w http.ResponseWriter) http.ResponseWriter {
+	return &countingResponseWriter{ResponseWriter: w, c: c}
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&cw.c.bytesSent, int64(n))
+		atomic.AddInt64(cw.c.stats.BytesSentHLS, int64(n))
+	}
+	return n, err
+}
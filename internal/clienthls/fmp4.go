@@ -0,0 +1,385 @@
+package clienthls
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+
+	"github.com/aler9/rtsp-simple-server/internal/h264"
+)
+
+// mp4Sample is a single fMP4 sample (one H264 access unit or one AAC
+// access unit), with its timing already converted to the track's
+// timescale, ready to be written into a 'trun'/'mdat' pair.
+type mp4Sample struct {
+	dts       uint64
+	duration  uint32
+	ctsOffset int32
+	isSync    bool
+	payload   []byte
+}
+
+// rawSample is a sample as captured at write time, before its duration
+// (which depends on the following sample) is known.
+type rawSample struct {
+	dts     time.Duration
+	pts     time.Duration
+	isSync  bool
+	payload []byte
+}
+
+// fmp4Part is a single CMAF part of a fMP4 segment, as used by the
+// fmp4 and lowLatency variants. Its 'moof'/'mdat' boxes are generated
+// lazily, the first time the part is read or flushed to disk.
+type fmp4Part struct {
+	seq      uint32
+	idx      int
+	duration time.Duration
+
+	videoSamples []rawSample
+	audioSamples []rawSample
+
+	built    []byte
+	diskPath string
+}
+
+// fmp4Segment is a fMP4 segment, composed of an init segment (shared
+// across the whole stream, see Client.initSegment) followed by one or
+// more CMAF parts.
+type fmp4Segment struct {
+	videoTrack   *gortsplib.Track
+	audioTrack   *gortsplib.Track
+	name         string
+	diskDir      string
+	maxSize      uint64
+	partDuration time.Duration
+
+	videoTrackID uint32
+	audioTrackID uint32
+
+	mutex                  sync.Mutex
+	size                   uint64
+	oversized              bool
+	audioSampleRate        int
+	parts                  []*fmp4Part
+	curPart                *fmp4Part
+	curPartStarted         time.Time
+	firstPacketWritten     bool
+	firstPacketWrittenTime time.Time
+}
+
+var fmp4SegmentCount uint64
+var fmp4PartSeq uint32
+
+func newFMP4Segment(
+	videoTrack *gortsplib.Track,
+	audioTrack *gortsplib.Track,
+	directory string,
+	partDuration time.Duration,
+	maxSize uint64) *fmp4Segment {
+	id := atomic.AddUint64(&fmp4SegmentCount, 1)
+
+	videoTrackID, audioTrackID := uint32(0), uint32(0)
+	nextID := uint32(1)
+	if videoTrack != nil {
+		videoTrackID = nextID
+		nextID++
+	}
+	if audioTrack != nil {
+		audioTrackID = nextID
+	}
+
+	return &fmp4Segment{
+		videoTrack:   videoTrack,
+		audioTrack:   audioTrack,
+		name:         strconv.FormatUint(id, 10),
+		diskDir:      directory,
+		partDuration: partDuration,
+		maxSize:      maxSize,
+		videoTrackID: videoTrackID,
+		audioTrackID: audioTrackID,
+	}
+}
+
+// Name returns the name of the segment, without extension.
+func (s *fmp4Segment) Name() string {
+	return s.name
+}
+
+// Close closes the last open part.
+func (s *fmp4Segment) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.curPart != nil {
+		s.finalizePart(s.curPart)
+	}
+	s.curPart = nil
+}
+
+// SetPCR is a no-op for fMP4, whose timestamps are carried in the
+// 'tfdt'/'trun' boxes rather than a PCR field.
+func (s *fmp4Segment) SetPCR(pcr time.Duration) {
+}
+
+// HasFirstPacketWritten returns whether a packet has already been written.
+func (s *fmp4Segment) HasFirstPacketWritten() bool {
+	return s.firstPacketWritten
+}
+
+// FirstPacketWrittenTime returns the time of the first written packet.
+func (s *fmp4Segment) FirstPacketWrittenTime() time.Time {
+	return s.firstPacketWrittenTime
+}
+
+func (s *fmp4Segment) currentPart() *fmp4Part {
+	if s.curPart == nil || time.Since(s.curPartStarted) >= s.partDuration {
+		if s.curPart != nil {
+			s.finalizePart(s.curPart)
+		}
+		s.curPart = &fmp4Part{seq: atomic.AddUint32(&fmp4PartSeq, 1), idx: len(s.parts)}
+		s.curPartStarted = time.Now()
+		s.parts = append(s.parts, s.curPart)
+	}
+	return s.curPart
+}
+
+// finalizePart records the actual elapsed duration of a part that has
+// just been rotated out (or closed) and, when hlsDirectory is
+// configured, flushes its 'moof'/'mdat' boxes to disk so that its raw
+// samples don't have to stay pinned in RAM for the rest of the DVR
+// window. Must be called with s.mutex held.
+func (s *fmp4Segment) finalizePart(p *fmp4Part) {
+	p.duration = time.Since(s.curPartStarted)
+
+	if s.diskDir == "" {
+		return
+	}
+
+	diskPath := filepath.Join(s.diskDir, s.name+".part"+strconv.Itoa(p.idx)+".mp4")
+	if err := os.WriteFile(diskPath, s.partBytes(p), 0o644); err != nil {
+		// best-effort: if the part can't be written to disk, it
+		// stays cached in memory and is served from there instead.
+		return
+	}
+
+	p.diskPath = diskPath
+	p.built = nil
+	p.videoSamples = nil
+	p.audioSamples = nil
+}
+
+// WriteH264 appends a H264 access unit, encoded as a fMP4 sample, to
+// the current part. SPS/PPS/AUD NALUs are stripped, since their
+// equivalent (SPS/PPS) is already carried once in the init segment's
+// 'avcC' box.
+func (s *fmp4Segment) WriteH264(dts time.Duration, pts time.Duration, isIDR bool, nalus [][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.firstPacketWritten {
+		s.firstPacketWritten = true
+		s.firstPacketWrittenTime = time.Now()
+	}
+
+	var payload []byte
+	for _, nalu := range nalus {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		switch typ {
+		case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+			continue
+		}
+		payload = append(payload, beUint32(uint32(len(nalu)))...)
+		payload = append(payload, nalu...)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	if s.maxSize != 0 && s.size+uint64(len(payload)) > s.maxSize {
+		s.oversized = true
+		return nil
+	}
+	s.size += uint64(len(payload))
+
+	p := s.currentPart()
+	p.videoSamples = append(p.videoSamples, rawSample{
+		dts:     dts,
+		pts:     pts,
+		isSync:  isIDR,
+		payload: payload,
+	})
+	return nil
+}
+
+// WriteAAC appends an AAC access unit to the current part.
+func (s *fmp4Segment) WriteAAC(sampleRate int, channelCount int, pts time.Duration, au []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.firstPacketWritten {
+		s.firstPacketWritten = true
+		s.firstPacketWrittenTime = time.Now()
+	}
+
+	s.audioSampleRate = sampleRate
+
+	if s.maxSize != 0 && s.size+uint64(len(au)) > s.maxSize {
+		s.oversized = true
+		return nil
+	}
+	s.size += uint64(len(au))
+
+	p := s.currentPart()
+	p.audioSamples = append(p.audioSamples, rawSample{
+		dts:     pts,
+		pts:     pts,
+		isSync:  true,
+		payload: au,
+	})
+	return nil
+}
+
+// DiskPath returns the on-disk path of a single part, if hlsDirectory
+// is set and that part has already been flushed to disk. Unlike
+// tsFile, a fMP4 segment spans several files (one per part, plus the
+// whole-segment view), so only individual parts are ever served
+// straight from disk; the whole-segment subpath always falls back to
+// Reader, which reassembles it from the parts.
+func (s *fmp4Segment) DiskPath(subpath string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, p := range s.parts {
+		if p.diskPath != "" && subpath == s.name+".part"+strconv.Itoa(p.idx)+".mp4" {
+			return p.diskPath, true
+		}
+	}
+	return "", false
+}
+
+// RemoveDisk removes the on-disk copy of every part that was flushed
+// to disk, if any.
+func (s *fmp4Segment) RemoveDisk() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, p := range s.parts {
+		if p.diskPath != "" {
+			os.Remove(p.diskPath)
+		}
+	}
+}
+
+// PartCount returns the number of parts generated so far. It is safe
+// to call from another goroutine while the segment is still being
+// written to: unlike s.parts, which is only ever mutated under
+// s.mutex, this takes that lock itself instead of relying on the
+// caller's own (different) lock.
+func (s *fmp4Segment) PartCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.parts)
+}
+
+// PartDurations returns the elapsed duration of every part generated
+// so far, in order. See PartCount for why this goes through s.mutex.
+func (s *fmp4Segment) PartDurations() []time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	durations := make([]time.Duration, len(s.parts))
+	for i, p := range s.parts {
+		durations[i] = p.duration
+	}
+	return durations
+}
+
+// Reader returns a reader for a given part, or for the whole
+// (non-low-latency) segment, generating the 'styp'/'moof'/'mdat' boxes
+// of each part on first access.
+func (s *fmp4Segment) Reader(subpath string) (io.Reader, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case subpath == s.name+".mp4":
+		var buf bytes.Buffer
+		for _, p := range s.parts {
+			buf.Write(s.partBytes(p))
+		}
+		return bytes.NewReader(buf.Bytes()), true
+
+	default:
+		for i, p := range s.parts {
+			if subpath == s.name+".part"+strconv.Itoa(i)+".mp4" {
+				return bytes.NewReader(s.partBytes(p)), true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// partBytes builds (and, unless already flushed to disk, caches) the
+// 'styp'/'moof'/'mdat' boxes of a part. Must be called with s.mutex held.
+func (s *fmp4Segment) partBytes(p *fmp4Part) []byte {
+	if p.built != nil {
+		return p.built
+	}
+
+	if p.diskPath != "" {
+		if b, err := os.ReadFile(p.diskPath); err == nil {
+			return b
+		}
+	}
+
+	videoSamples := toMP4Samples(p.videoSamples, videoTimescale, s.partDuration)
+	audioSampleRate := s.audioSampleRate
+	if audioSampleRate == 0 {
+		audioSampleRate = 1
+	}
+	audioSamples := toMP4Samples(p.audioSamples, uint32(audioSampleRate), s.partDuration)
+
+	p.built = buildMediaSegment(p.seq, s.videoTrackID, videoSamples, s.audioTrackID, audioSamples)
+	return p.built
+}
+
+// toMP4Samples converts a list of raw samples into fMP4 samples in the
+// given timescale, deriving each sample's duration from the following
+// sample's DTS (the last sample uses the part's nominal duration).
+func toMP4Samples(raw []rawSample, timescale uint32, fallbackDuration time.Duration) []mp4Sample {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	toTicks := func(d time.Duration) uint64 {
+		return uint64(d * time.Duration(timescale) / time.Second)
+	}
+
+	samples := make([]mp4Sample, len(raw))
+	for i, r := range raw {
+		var duration uint64
+		if i+1 < len(raw) {
+			duration = toTicks(raw[i+1].dts) - toTicks(r.dts)
+		} else {
+			duration = toTicks(fallbackDuration)
+		}
+
+		samples[i] = mp4Sample{
+			dts:       toTicks(r.dts),
+			duration:  uint32(duration),
+			ctsOffset: int32(toTicks(r.pts)) - int32(toTicks(r.dts)),
+			isSync:    r.isSync,
+			payload:   r.payload,
+		}
+	}
+	return samples
+}
@@ -0,0 +1,488 @@
+package clienthls
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// box wraps payload with a ISO-BMFF box header (4-byte big-endian size
+// followed by the 4-byte ASCII type).
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, beUint32(uint32(size))...)
+	buf = append(buf, []byte(typ)...)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// fullBox is a box whose payload starts with a 1-byte version and a
+// 3-byte flags field, as used by most ISO-BMFF boxes.
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{head}, payload...)...)
+}
+
+func beUint16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func beUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func beUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// descriptor encodes a MPEG-4 descriptor tag (ISO/IEC 14496-1), using a
+// single-byte length since every descriptor used here is well under 128
+// bytes.
+func descriptor(tag byte, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	buf := []byte{tag, byte(size)}
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// parseSPSDimensions extracts the coded width and height from a H264
+// SPS NALU, decoding just enough of its Exp-Golomb fields to find them.
+// It returns a sane default if the SPS cannot be parsed, since playback
+// is still possible without exact dimensions in the 'tkhd'/'avc1' boxes.
+func parseSPSDimensions(sps []byte) (width int, height int) {
+	width, height = 1280, 720
+
+	if len(sps) < 4 {
+		return
+	}
+
+	r := &bitReader{buf: sps[1:]}
+
+	profileIdc := sps[1]
+	r.skipBits(8 + 8 + 8) // profile_idc, constraint flags + level_idc
+
+	r.readUE() // seq_parameter_set_id
+
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134:
+		chromaFormatIdc := r.readUE()
+		if chromaFormatIdc == 3 {
+			r.skipBits(1)
+		}
+		r.readUE() // bit_depth_luma_minus8
+		r.readUE() // bit_depth_chroma_minus8
+		r.skipBits(1)
+		if r.readBit() == 1 { // seq_scaling_matrix_present_flag
+			n := 8
+			if chromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.readBit() == 1 {
+					r.skipScalingList()
+				}
+			}
+		}
+	}
+
+	r.readUE() // log2_max_frame_num_minus4
+	picOrderCntType := r.readUE()
+	if picOrderCntType == 0 {
+		r.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	} else if picOrderCntType == 1 {
+		r.skipBits(1)
+		r.readSE()
+		r.readSE()
+		n := r.readUE()
+		for i := uint(0); i < n; i++ {
+			r.readSE()
+		}
+	}
+
+	r.readUE() // max_num_ref_frames
+	r.skipBits(1)
+
+	picWidthInMbsMinus1 := r.readUE()
+	picHeightInMapUnitsMinus1 := r.readUE()
+	frameMbsOnlyFlag := r.readBit()
+	if frameMbsOnlyFlag == 0 {
+		r.skipBits(1)
+	}
+	r.skipBits(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if r.readBit() == 1 { // frame_cropping_flag
+		cropLeft = r.readUE()
+		cropRight = r.readUE()
+		cropTop = r.readUE()
+		cropBottom = r.readUE()
+	}
+
+	if r.err != nil {
+		return
+	}
+
+	frameMbsOnlyMul := uint(2)
+	if frameMbsOnlyFlag == 1 {
+		frameMbsOnlyMul = 1
+	}
+
+	width = int((picWidthInMbsMinus1+1)*16 - cropLeft*2 - cropRight*2)
+	height = int(frameMbsOnlyMul*(picHeightInMapUnitsMinus1+1)*16 -
+		cropTop*2*frameMbsOnlyMul - cropBottom*2*frameMbsOnlyMul)
+
+	if width <= 0 || height <= 0 {
+		width, height = 1280, 720
+	}
+	return
+}
+
+// bitReader is a minimal MSB-first bit reader, used to parse the
+// Exp-Golomb-coded fields of a H264 SPS.
+type bitReader struct {
+	buf    []byte
+	bitPos int
+	err    error
+}
+
+func (r *bitReader) readBit() uint {
+	bytePos := r.bitPos / 8
+	if bytePos >= len(r.buf) {
+		r.err = fmt.Errorf("unexpected end of SPS")
+		return 0
+	}
+	bit := (r.buf[bytePos] >> (7 - uint(r.bitPos%8))) & 0x01
+	r.bitPos++
+	return uint(bit)
+}
+
+func (r *bitReader) skipBits(n int) {
+	for i := 0; i < n; i++ {
+		r.readBit()
+	}
+}
+
+func (r *bitReader) readUE() uint {
+	leadingZeros := 0
+	for r.readBit() == 0 {
+		leadingZeros++
+		if r.err != nil || leadingZeros > 32 {
+			return 0
+		}
+	}
+
+	var v uint
+	for i := 0; i < leadingZeros; i++ {
+		v = (v << 1) | r.readBit()
+	}
+	return (1 << uint(leadingZeros)) - 1 + v
+}
+
+func (r *bitReader) readSE() int {
+	v := r.readUE()
+	if v%2 == 0 {
+		return -int(v / 2)
+	}
+	return int(v+1) / 2
+}
+
+func (r *bitReader) skipScalingList() {
+	lastScale, nextScale := 8, 8
+	for i := 0; i < 16 && r.err == nil; i++ {
+		if nextScale != 0 {
+			delta := r.readSE()
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
+
+// buildInitSegment generates a fMP4 init segment ('ftyp' + 'moov') for
+// the given tracks, using the H264 SPS/PPS and the raw AAC
+// AudioSpecificConfig to fill in the 'avcC'/'esds' decoder configuration.
+func buildInitSegment(hasVideo bool, sps []byte, pps []byte,
+	hasAudio bool, audioConfig []byte, sampleRate int, channelCount int) []byte {
+	ftyp := box("ftyp",
+		[]byte("iso5"), beUint32(512),
+		[]byte("iso5"), []byte("iso6"), []byte("mp41"))
+
+	nextTrackID := uint32(1)
+	var traks []byte
+	if hasVideo {
+		traks = append(traks, trakVideo(1, sps, pps)...)
+		nextTrackID++
+	}
+	if hasAudio {
+		traks = append(traks, trakAudio(nextTrackID, audioConfig, sampleRate, channelCount)...)
+		nextTrackID++
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		beUint32(0), beUint32(0), // creation/modification time
+		beUint32(1000),           // timescale
+		beUint32(0),              // duration (unknown, fragmented)
+		beUint32(0x00010000),     // rate
+		beUint16(0x0100),         // volume
+		make([]byte, 10),         // reserved
+		identityMatrix(),
+		make([]byte, 24), // pre_defined
+		beUint32(nextTrackID))
+
+	var mvexEntries []byte
+	if hasVideo {
+		mvexEntries = append(mvexEntries, fullBox("trex", 0, 0,
+			beUint32(1), beUint32(1), beUint32(0), beUint32(0), beUint32(0))...)
+	}
+	if hasAudio {
+		id := uint32(1)
+		if hasVideo {
+			id = 2
+		}
+		mvexEntries = append(mvexEntries, fullBox("trex", 0, 0,
+			beUint32(id), beUint32(1), beUint32(0), beUint32(0), beUint32(0))...)
+	}
+	mvex := box("mvex", mvexEntries)
+
+	moov := box("moov", mvhd, traks, mvex)
+
+	return append(ftyp, moov...)
+}
+
+// identityMatrix returns the 9 32-bit fixed-point values (36 bytes) of
+// the identity transformation matrix used by 'mvhd'/'tkhd'.
+func identityMatrix() []byte {
+	var buf []byte
+	buf = append(buf, beUint32(0x00010000)...) // a = 1.0
+	buf = append(buf, beUint32(0)...)          // b
+	buf = append(buf, beUint32(0)...)          // u
+	buf = append(buf, beUint32(0)...)          // c
+	buf = append(buf, beUint32(0x00010000)...) // d = 1.0
+	buf = append(buf, beUint32(0)...)          // v
+	buf = append(buf, beUint32(0)...)          // x
+	buf = append(buf, beUint32(0)...)          // y
+	buf = append(buf, beUint32(0x40000000)...) // w = 1.0
+	return buf
+}
+
+func tkhd(trackID uint32, isAudio bool, width int, height int) []byte {
+	volume := uint16(0)
+	if isAudio {
+		volume = 0x0100
+	}
+
+	w, h := uint32(0), uint32(0)
+	if !isAudio {
+		w = uint32(width) << 16
+		h = uint32(height) << 16
+	}
+
+	return fullBox("tkhd", 0, 0x000007,
+		beUint32(0), beUint32(0), // creation/modification time
+		beUint32(trackID),
+		beUint32(0),      // reserved
+		beUint32(0),      // duration
+		make([]byte, 8),  // reserved
+		beUint16(0),      // layer
+		beUint16(0),      // alternate_group
+		beUint16(volume),
+		beUint16(0), // reserved
+		identityMatrix(),
+		beUint32(w), beUint32(h))
+}
+
+func mdhd(timescale uint32) []byte {
+	return fullBox("mdhd", 0, 0,
+		beUint32(0), beUint32(0), // creation/modification time
+		beUint32(timescale),
+		beUint32(0),      // duration
+		beUint16(0x55c4), // language "und"
+		beUint16(0))
+}
+
+func hdlr(handlerType string, name string) []byte {
+	return fullBox("hdlr", 0, 0,
+		beUint32(0), []byte(handlerType), make([]byte, 12), []byte(name+"\x00"))
+}
+
+func dinf() []byte {
+	urlBox := fullBox("url ", 0, 1)
+	dref := fullBox("dref", 0, 0, beUint32(1), urlBox)
+	return box("dinf", dref)
+}
+
+func trakVideo(trackID uint32, sps []byte, pps []byte) []byte {
+	width, height := parseSPSDimensions(sps)
+
+	var profile, compat, level byte
+	if len(sps) >= 4 {
+		profile, compat, level = sps[1], sps[2], sps[3]
+	}
+
+	avcC := box("avcC",
+		[]byte{1, profile, compat, level, 0xFF},
+		[]byte{0xE1}, beUint16(uint16(len(sps))), sps,
+		[]byte{1}, beUint16(uint16(len(pps))), pps)
+
+	avc1 := box("avc1",
+		make([]byte, 6), beUint16(1), // reserved, data_reference_index
+		beUint16(0), beUint16(0), make([]byte, 12), // pre_defined/reserved
+		beUint16(uint16(width)), beUint16(uint16(height)),
+		beUint32(0x00480000), beUint32(0x00480000), // h/v resolution
+		beUint32(0),      // reserved
+		beUint16(1),      // frame_count
+		make([]byte, 32), // compressorname
+		beUint16(0x0018), // depth
+		beUint16(0xFFFF), // pre_defined
+		avcC)
+
+	stsd := fullBox("stsd", 0, 0, beUint32(1), avc1)
+	stbl := box("stbl", stsd, emptyStts(), emptyStsc(), emptyStsz(), emptyStco())
+
+	minf := box("minf",
+		fullBox("vmhd", 0, 1, beUint16(0), make([]byte, 6)),
+		dinf(), stbl)
+
+	mdia := box("mdia", mdhd(videoTimescale), hdlr("vide", "VideoHandler"), minf)
+
+	return box("trak", tkhd(trackID, false, width, height), mdia)
+}
+
+func trakAudio(trackID uint32, audioConfig []byte, sampleRate int, channelCount int) []byte {
+	decSpecificInfo := descriptor(0x05, audioConfig)
+	decoderConfig := descriptor(0x04,
+		[]byte{0x40, 0x15},
+		[]byte{0, 0, 0}, // bufferSizeDB
+		beUint32(0),     // maxBitrate
+		beUint32(0),     // avgBitrate
+		decSpecificInfo)
+	slConfig := descriptor(0x06, []byte{0x02})
+	es := descriptor(0x03, beUint16(0), []byte{0}, decoderConfig, slConfig)
+
+	esds := fullBox("esds", 0, 0, es)
+
+	mp4a := box("mp4a",
+		make([]byte, 6), beUint16(1), // reserved, data_reference_index
+		make([]byte, 8), // reserved
+		beUint16(uint16(channelCount)),
+		beUint16(0x0010), // samplesize
+		beUint16(0),      // pre_defined
+		beUint16(0),      // reserved
+		beUint32(uint32(sampleRate)<<16),
+		esds)
+
+	stsd := fullBox("stsd", 0, 0, beUint32(1), mp4a)
+	stbl := box("stbl", stsd, emptyStts(), emptyStsc(), emptyStsz(), emptyStco())
+
+	minf := box("minf",
+		fullBox("smhd", 0, 0, beUint16(0), beUint16(0)),
+		dinf(), stbl)
+
+	mdia := box("mdia", mdhd(uint32(sampleRate)), hdlr("soun", "SoundHandler"), minf)
+
+	return box("trak", tkhd(trackID, true, 0, 0), mdia)
+}
+
+func emptyStts() []byte { return fullBox("stts", 0, 0, beUint32(0)) }
+func emptyStsc() []byte { return fullBox("stsc", 0, 0, beUint32(0)) }
+func emptyStsz() []byte { return fullBox("stsz", 0, 0, beUint32(0), beUint32(0)) }
+func emptyStco() []byte { return fullBox("stco", 0, 0, beUint32(0)) }
+
+// videoTimescale is the timescale used for the video track, matching
+// the 90 kHz clock already used throughout the RTP/MPEG-TS pipeline.
+const videoTimescale = 90000
+
+const (
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// buildMediaSegment generates a LL-HLS/fMP4 media fragment ('styp' +
+// 'moof' + 'mdat') for a single part, carrying up to one video and one
+// audio track fragment.
+func buildMediaSegment(seq uint32, videoTrackID uint32, videoSamples []mp4Sample,
+	audioTrackID uint32, audioSamples []mp4Sample) []byte {
+	styp := box("styp", []byte("msdh"), beUint32(0), []byte("msdh"), []byte("msix"))
+
+	// first pass: build with zero data offsets just to measure moof size.
+	moofLen := len(buildMoof(seq, videoTrackID, videoSamples, 0, audioTrackID, audioSamples, 0))
+
+	videoBytes := concatSamplePayloads(videoSamples)
+	videoOffset := uint32(moofLen + 8)
+	audioOffset := videoOffset + uint32(len(videoBytes))
+
+	moof := buildMoof(seq, videoTrackID, videoSamples, videoOffset, audioTrackID, audioSamples, audioOffset)
+
+	audioBytes := concatSamplePayloads(audioSamples)
+	mdat := box("mdat", videoBytes, audioBytes)
+
+	return append(styp, append(moof, mdat...)...)
+}
+
+func concatSamplePayloads(samples []mp4Sample) []byte {
+	var buf []byte
+	for _, s := range samples {
+		buf = append(buf, s.payload...)
+	}
+	return buf
+}
+
+func buildMoof(seq uint32, videoTrackID uint32, videoSamples []mp4Sample, videoDataOffset uint32,
+	audioTrackID uint32, audioSamples []mp4Sample, audioDataOffset uint32) []byte {
+	mfhd := fullBox("mfhd", 0, 0, beUint32(seq))
+
+	var trafs []byte
+	if len(videoSamples) > 0 {
+		trafs = append(trafs, traf(videoTrackID, videoSamples, videoDataOffset, true)...)
+	}
+	if len(audioSamples) > 0 {
+		trafs = append(trafs, traf(audioTrackID, audioSamples, audioDataOffset, false)...)
+	}
+
+	return box("moof", mfhd, trafs)
+}
+
+func traf(trackID uint32, samples []mp4Sample, dataOffset uint32, isVideo bool) []byte {
+	tfhd := fullBox("tfhd", 0, 0x020000, beUint32(trackID))
+	tfdt := fullBox("tfdt", 1, 0, beUint64(uint64(samples[0].dts)))
+
+	flags := uint32(0x000001 | 0x000100 | 0x000200)
+	if isVideo {
+		flags |= 0x000400 | 0x000800
+	}
+
+	payload := [][]byte{beUint32(uint32(len(samples))), beUint32(dataOffset)}
+	for _, s := range samples {
+		payload = append(payload, beUint32(uint32(s.duration)), beUint32(uint32(len(s.payload))))
+		if isVideo {
+			sampleFlags := uint32(sampleFlagsNonSync)
+			if s.isSync {
+				sampleFlags = sampleFlagsSync
+			}
+			payload = append(payload, beUint32(sampleFlags), beUint32(uint32(int32(s.ctsOffset))))
+		}
+	}
+
+	trun := fullBox("trun", 1, flags, payload...)
+
+	return box("traf", tfhd, tfdt, trun)
+}
@@ -0,0 +1,241 @@
+package clienthls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/asticode/go-astits"
+)
+
+// segment is implemented by tsFile (MPEG-TS variant) and fmp4Segment
+// (fMP4 / low-latency variant).
+type segment interface {
+	Name() string
+	Close()
+	SetPCR(time.Duration)
+	WriteH264(dts time.Duration, pts time.Duration, isIDR bool, nalus [][]byte) error
+	WriteAAC(sampleRate int, channelCount int, pts time.Duration, au []byte) error
+	HasFirstPacketWritten() bool
+	FirstPacketWrittenTime() time.Time
+	Reader(name string) (io.Reader, bool)
+	DiskPath(subpath string) (string, bool)
+	RemoveDisk()
+}
+
+var tsFileCount uint64
+
+// tsFile is a MPEG-TS segment.
+type tsFile struct {
+	videoTrack *gortsplib.Track
+	audioTrack *gortsplib.Track
+	name       string
+	maxSize    uint64
+
+	buf                    bytes.Buffer
+	size                   uint64
+	mux                    *astits.Muxer
+	firstPacketWritten     bool
+	firstPacketWrittenTime time.Time
+	diskPath               string
+	diskFile               *os.File
+	oversized              bool
+}
+
+func newTSFile(
+	videoTrack *gortsplib.Track,
+	audioTrack *gortsplib.Track,
+	directory string,
+	maxSize uint64) *tsFile {
+	id := atomic.AddUint64(&tsFileCount, 1)
+
+	f := &tsFile{
+		videoTrack: videoTrack,
+		audioTrack: audioTrack,
+		name:       strconv.FormatUint(id, 10),
+		maxSize:    maxSize,
+	}
+
+	if directory != "" {
+		f.diskPath = filepath.Join(directory, f.name+".ts")
+		// best-effort: if the file can't be created, the segment
+		// falls back to being served from memory only.
+		if df, err := os.Create(f.diskPath); err == nil {
+			f.diskFile = df
+		} else {
+			f.diskPath = ""
+		}
+	}
+
+	f.mux = astits.NewMuxer(nil, f.writePacket)
+
+	if videoTrack != nil {
+		f.mux.AddElementaryStream(astits.PMTElementaryStream{
+			ElementaryPID: 256,
+			StreamType:    astits.StreamTypeH264Video,
+		})
+	}
+	if audioTrack != nil {
+		f.mux.AddElementaryStream(astits.PMTElementaryStream{
+			ElementaryPID: 257,
+			StreamType:    astits.StreamTypeAACAudio,
+		})
+	}
+
+	return f
+}
+
+// writePacket is called by astits for every MPEG-TS packet produced by
+// the muxer. When a disk path is configured, packets are written there
+// only: handleSegmentRequest always prefers DiskPath() over Reader()
+// in that case, so keeping a parallel in-memory copy would just pin
+// the whole DVR window in RAM for nothing.
+func (f *tsFile) writePacket(p []byte) (int, error) {
+	if f.oversized {
+		return len(p), nil
+	}
+
+	if f.diskFile != nil {
+		if f.maxSize != 0 && uint64(f.size+uint64(len(p))) > f.maxSize {
+			f.oversized = true
+			return len(p), nil
+		}
+		f.size += uint64(len(p))
+
+		if _, err := f.diskFile.Write(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if f.maxSize != 0 && uint64(f.buf.Len()+len(p)) > f.maxSize {
+		f.oversized = true
+		return len(p), nil
+	}
+
+	return f.buf.Write(p)
+}
+
+// Name returns the name of the segment, without extension.
+func (f *tsFile) Name() string {
+	return f.name
+}
+
+// Close closes a tsFile.
+func (f *tsFile) Close() {
+	if f.diskFile != nil {
+		f.diskFile.Close()
+	}
+}
+
+// DiskPath returns the on-disk path of the segment, if hlsDirectory is
+// set. tsFile has no sub-parts, so subpath is only checked against the
+// segment's own name.
+func (f *tsFile) DiskPath(subpath string) (string, bool) {
+	if subpath != f.name+".ts" {
+		return "", false
+	}
+	return f.diskPath, f.diskPath != ""
+}
+
+// RemoveDisk removes the on-disk copy of the segment, if any.
+func (f *tsFile) RemoveDisk() {
+	if f.diskPath != "" {
+		os.Remove(f.diskPath)
+	}
+}
+
+// SetPCR ignores the given value: tsFile does not write it into the
+// MPEG-TS PCR field.
+func (f *tsFile) SetPCR(pcr time.Duration) {
+}
+
+// HasFirstPacketWritten returns whether a packet has already been written.
+func (f *tsFile) HasFirstPacketWritten() bool {
+	return f.firstPacketWritten
+}
+
+// FirstPacketWrittenTime returns the time of the first written packet.
+func (f *tsFile) FirstPacketWrittenTime() time.Time {
+	return f.firstPacketWrittenTime
+}
+
+// WriteH264 writes a H264 access unit.
+func (f *tsFile) WriteH264(dts time.Duration, pts time.Duration, isIDR bool, nalus [][]byte) error {
+	if !f.firstPacketWritten {
+		f.firstPacketWritten = true
+		f.firstPacketWrittenTime = time.Now()
+	}
+
+	buf := make([]byte, 0, 128)
+	for _, nalu := range nalus {
+		buf = append(buf, 0x00, 0x00, 0x00, 0x01)
+		buf = append(buf, nalu...)
+	}
+
+	_, err := f.mux.WriteData(&astits.MuxerData{
+		PID: 256,
+		PES: &astits.PESData{
+			Data: buf,
+			Header: &astits.PESHeader{
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:     2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorBothPresent,
+					DTS:            &astits.ClockReference{Base: int64((dts * 90000) / time.Second)},
+					PTS:            &astits.ClockReference{Base: int64((pts * 90000) / time.Second)},
+				},
+			},
+			PacketLength: uint16(len(buf) + 8 + 5),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write segment data: %s", err)
+	}
+
+	return nil
+}
+
+// WriteAAC writes an AAC access unit.
+func (f *tsFile) WriteAAC(sampleRate int, channelCount int, pts time.Duration, au []byte) error {
+	if !f.firstPacketWritten {
+		f.firstPacketWritten = true
+		f.firstPacketWrittenTime = time.Now()
+	}
+
+	_, err := f.mux.WriteData(&astits.MuxerData{
+		PID: 257,
+		PES: &astits.PESData{
+			Data: au,
+			Header: &astits.PESHeader{
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:     2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+					PTS:            &astits.ClockReference{Base: int64((pts * 90000) / time.Second)},
+				},
+			},
+			PacketLength: uint16(len(au) + 8),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write segment data: %s", err)
+	}
+
+	return nil
+}
+
+// Reader returns a reader for the given subpath (the segment itself,
+// since tsFile has no sub-parts). It only serves from the in-memory
+// buffer: when a disk path is configured, writePacket never fills it,
+// and callers are expected to use DiskPath() instead.
+func (f *tsFile) Reader(subpath string) (io.Reader, bool) {
+	if subpath != f.name+".ts" || f.diskPath != "" {
+		return nil, false
+	}
+	return bytes.NewReader(f.buf.Bytes()), true
+}
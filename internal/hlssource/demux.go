@@ -0,0 +1,94 @@
+package hlssource
+
+// splitNALUs splits an Annex-B byte stream (as carried by a H264 PES
+// packet) into its individual NALUs, stripping the 3- or 4-byte start
+// codes.
+func splitNALUs(annexb []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+
+	for i := 0; i < len(annexb); {
+		scLen := startCodeLen(annexb[i:])
+		if scLen == 0 {
+			i++
+			continue
+		}
+
+		if start >= 0 {
+			nalus = append(nalus, annexb[start:i])
+		}
+		i += scLen
+		start = i
+	}
+
+	if start >= 0 && start < len(annexb) {
+		nalus = append(nalus, annexb[start:])
+	}
+
+	return nalus
+}
+
+// startCodeLen returns the length of the Annex-B start code (0x000001
+// or 0x00000001) at the beginning of buf, or 0 if there is none.
+func startCodeLen(buf []byte) int {
+	switch {
+	case len(buf) >= 4 && buf[0] == 0 && buf[1] == 0 && buf[2] == 0 && buf[3] == 1:
+		return 4
+	case len(buf) >= 3 && buf[0] == 0 && buf[1] == 0 && buf[2] == 1:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// adtsFrame is a single AAC access unit extracted from an ADTS stream,
+// along with the parameters carried by its header.
+type adtsFrame struct {
+	sampleRate int
+	payload    []byte
+}
+
+var adtsSampleRates = [...]int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050,
+	16000, 12000, 11025, 8000, 7350, 0, 0, 0,
+}
+
+// splitADTSFrames extracts every AAC access unit contained in buf,
+// which is expected to be one or more concatenated ADTS frames (as
+// carried by an AAC PES packet in a MPEG-TS stream).
+func splitADTSFrames(buf []byte) []adtsFrame {
+	var frames []adtsFrame
+
+	for i := 0; i+7 <= len(buf); {
+		// ADTS sync word: 12 bits set to 1.
+		if buf[i] != 0xFF || buf[i+1]&0xF0 != 0xF0 {
+			i++
+			continue
+		}
+
+		frameLen := (int(buf[i+3]&0x03) << 11) | (int(buf[i+4]) << 3) | (int(buf[i+5]) >> 5)
+		if frameLen < 7 || i+frameLen > len(buf) {
+			break
+		}
+
+		headerLen := 7
+		if buf[i+1]&0x01 == 0 { // no CRC absence bit means CRC is present
+			headerLen = 9
+		}
+		if frameLen <= headerLen {
+			break
+		}
+
+		sampleRateIndex := (buf[i+2] >> 2) & 0x0F
+		sampleRate := adtsSampleRates[sampleRateIndex]
+
+		frames = append(frames, adtsFrame{
+			sampleRate: sampleRate,
+			payload:    buf[i+headerLen : i+frameLen],
+		})
+
+		i += frameLen
+	}
+
+	return frames
+}
@@ -0,0 +1,148 @@
+package hlssource
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// playlistVariant is a single entry of a HLS master playlist.
+type playlistVariant struct {
+	bandwidth int
+	uri       *url.URL
+}
+
+// playlist is a parsed HLS playlist. It is either a master playlist
+// (isMaster == true, variants populated) or a media playlist
+// (targetURIs / mediaSequence populated).
+type playlist struct {
+	isMaster      bool
+	variants      []playlistVariant
+	mediaSequence int
+	targetURIs    []*url.URL
+}
+
+// parsePlaylist parses a HLS master or media playlist, resolving any
+// URI it contains against the playlist base URL.
+func parsePlaylist(base *url.URL, r io.Reader) (*playlist, error) {
+	scanner := bufio.NewScanner(r)
+
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("empty playlist")
+	}
+	if strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, fmt.Errorf("invalid playlist: missing #EXTM3U")
+	}
+
+	pl := &playlist{}
+	pendingBandwidth := -1
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			pl.isMaster = true
+			pendingBandwidth = parseBandwidth(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			v, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXT-X-MEDIA-SEQUENCE: %s", line)
+			}
+			pl.mediaSequence = v
+
+		case strings.HasPrefix(line, "#"):
+			continue
+
+		default:
+			u, err := url.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URI '%s': %s", line, err)
+			}
+			resolved := base.ResolveReference(u)
+
+			if pl.isMaster {
+				pl.variants = append(pl.variants, playlistVariant{
+					bandwidth: pendingBandwidth,
+					uri:       resolved,
+				})
+				pendingBandwidth = -1
+			} else {
+				pl.targetURIs = append(pl.targetURIs, resolved)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if pl.isMaster && len(pl.variants) == 0 {
+		return nil, fmt.Errorf("master playlist has no variants")
+	}
+
+	return pl, nil
+}
+
+// parseBandwidth extracts the BANDWIDTH attribute from the attribute
+// list of a #EXT-X-STREAM-INF tag. It returns -1 if not found.
+func parseBandwidth(attrs string) int {
+	for _, attr := range strings.Split(attrs, ",") {
+		kv := strings.SplitN(strings.TrimSpace(attr), "=", 2)
+		if len(kv) == 2 && kv[0] == "BANDWIDTH" {
+			if v, err := strconv.Atoi(kv[1]); err == nil {
+				return v
+			}
+		}
+	}
+	return -1
+}
+
+// bestVariant returns the highest-bandwidth variant of a master
+// playlist.
+func (pl *playlist) bestVariant() *url.URL {
+	best := pl.variants[0]
+	for _, v := range pl.variants[1:] {
+		if v.bandwidth > best.bandwidth {
+			best = v
+		}
+	}
+	return best.uri
+}
+
+// segmentTracker keeps track of which segment URIs have already been
+// downloaded, so that the live sliding window can be followed without
+// re-downloading segments.
+type segmentTracker struct {
+	downloaded map[string]struct{}
+}
+
+func newSegmentTracker() *segmentTracker {
+	return &segmentTracker{
+		downloaded: make(map[string]struct{}),
+	}
+}
+
+// filterNew returns the URIs in pl that have not been downloaded yet,
+// and marks them as downloaded.
+func (t *segmentTracker) filterNew(pl *playlist) []*url.URL {
+	var ret []*url.URL
+
+	for _, u := range pl.targetURIs {
+		key := u.String()
+		if _, ok := t.downloaded[key]; ok {
+			continue
+		}
+		t.downloaded[key] = struct{}{}
+		ret = append(ret, u)
+	}
+
+	return ret
+}
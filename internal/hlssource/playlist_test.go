@@ -0,0 +1,105 @@
+package hlssource
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("invalid URL '%s': %s", raw, err)
+	}
+	return u
+}
+
+func TestParsePlaylistMedia(t *testing.T) {
+	base := mustParseURL(t, "http://example.com/stream/index.m3u8")
+
+	const in = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-MEDIA-SEQUENCE:5
+#EXTINF:10,
+segment5.ts
+#EXTINF:10,
+segment6.ts
+`
+
+	pl, err := parsePlaylist(base, strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pl.isMaster {
+		t.Fatal("should not be detected as a master playlist")
+	}
+	if pl.mediaSequence != 5 {
+		t.Fatalf("expected mediaSequence 5, got %d", pl.mediaSequence)
+	}
+	if len(pl.targetURIs) != 2 {
+		t.Fatalf("expected 2 segment URIs, got %d", len(pl.targetURIs))
+	}
+	if pl.targetURIs[0].String() != "http://example.com/stream/segment5.ts" {
+		t.Fatalf("unexpected resolved URI: %s", pl.targetURIs[0])
+	}
+}
+
+func TestParsePlaylistMaster(t *testing.T) {
+	base := mustParseURL(t, "http://example.com/stream/master.m3u8")
+
+	const in = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2800000
+high/index.m3u8
+`
+
+	pl, err := parsePlaylist(base, strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pl.isMaster {
+		t.Fatal("should be detected as a master playlist")
+	}
+	if len(pl.variants) != 2 {
+		t.Fatalf("expected 2 variants, got %d", len(pl.variants))
+	}
+
+	best := pl.bestVariant()
+	if best.String() != "http://example.com/stream/high/index.m3u8" {
+		t.Fatalf("expected the highest-bandwidth variant, got %s", best)
+	}
+}
+
+func TestSegmentTrackerFilterNew(t *testing.T) {
+	base := mustParseURL(t, "http://example.com/stream/index.m3u8")
+	tracker := newSegmentTracker()
+
+	pl1, err := parsePlaylist(base, strings.NewReader(
+		"#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:10,\nseg0.ts\n#EXTINF:10,\nseg1.ts\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := tracker.filterNew(pl1)
+	if len(first) != 2 {
+		t.Fatalf("expected 2 new segments, got %d", len(first))
+	}
+
+	// the sliding window drops seg0 and adds seg2: only seg2 is new.
+	pl2, err := parsePlaylist(base, strings.NewReader(
+		"#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:10,\nseg1.ts\n#EXTINF:10,\nseg2.ts\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := tracker.filterNew(pl2)
+	if len(second) != 1 {
+		t.Fatalf("expected 1 new segment, got %d", len(second))
+	}
+	if second[0].String() != "http://example.com/stream/seg2.ts" {
+		t.Fatalf("unexpected new segment: %s", second[0])
+	}
+}
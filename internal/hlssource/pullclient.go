@@ -0,0 +1,428 @@
+package hlssource
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astits"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/rtpaac"
+	"github.com/aler9/gortsplib/pkg/rtph264"
+)
+
+const (
+	segmentQueueSize = 100
+)
+
+type trackIDPayloadPair struct {
+	trackID int
+	payload []byte
+}
+
+// pullClient downloads a remote HLS playlist and its segments, demuxes
+// the MPEG-TS streams they contain, and makes the resulting RTP-like
+// track/payload pairs available on the frame channel.
+type pullClient struct {
+	ur         string
+	httpClient *http.Client
+	ctx        context.Context
+	ctxCancel  func()
+
+	videoTrack *gortsplib.Track
+	audioTrack *gortsplib.Track
+	videoPID   uint16
+	audioPID   uint16
+
+	h264Encoder *rtph264.Encoder
+	aacEncoder  *rtpaac.Encoder
+
+	segmentQueue chan *url.URL
+	frame        chan trackIDPayloadPair
+	errc         chan error
+
+	clockStartPTS time.Duration
+	clockSet      bool
+
+	wg sync.WaitGroup
+}
+
+func newPullClient(ctxParent context.Context, ur string, httpClient *http.Client) *pullClient {
+	ctx, ctxCancel := context.WithCancel(ctxParent)
+
+	return &pullClient{
+		ur:           ur,
+		httpClient:   httpClient,
+		ctx:          ctx,
+		ctxCancel:    ctxCancel,
+		segmentQueue: make(chan *url.URL, segmentQueueSize),
+		frame:        make(chan trackIDPayloadPair),
+		errc:         make(chan error, 1),
+	}
+}
+
+func (pc *pullClient) close() {
+	pc.ctxCancel()
+	pc.wg.Wait()
+}
+
+// start fetches the playlist and waits until both the video and audio
+// tracks (if present) have been observed in the PMT, then starts
+// downloading and demuxing segments in background. It returns the
+// detected tracks, or nil plus an error on errc if the stream could not
+// be set up.
+func (pc *pullClient) start() (gortsplib.Tracks, chan error) {
+	base, err := url.Parse(pc.ur)
+	if err != nil {
+		pc.errc <- err
+		return nil, pc.errc
+	}
+
+	pl, err := pc.fetchPlaylist(base)
+	if err != nil {
+		pc.errc <- err
+		return nil, pc.errc
+	}
+
+	if pl.isMaster {
+		base = pl.bestVariant()
+		pl, err = pc.fetchPlaylist(base)
+		if err != nil {
+			pc.errc <- err
+			return nil, pc.errc
+		}
+		if pl.isMaster {
+			pc.errc <- fmt.Errorf("variant playlist is itself a master playlist")
+			return nil, pc.errc
+		}
+	}
+
+	tracker := newSegmentTracker()
+	uris := tracker.filterNew(pl)
+	if len(uris) == 0 {
+		pc.errc <- fmt.Errorf("playlist has no segments")
+		return nil, pc.errc
+	}
+
+	tracks, err := pc.detectTracks(uris[0])
+	if err != nil {
+		pc.errc <- err
+		return nil, pc.errc
+	}
+
+	// uris[0] was only downloaded to detect the tracks, its payload was
+	// discarded; the rest of the live window is still unseen and must
+	// be queued now, since filterNew already marked all of uris as
+	// downloaded and won't offer them again on the next reload.
+	for _, u := range uris[1:] {
+		select {
+		case pc.segmentQueue <- u:
+		case <-pc.ctx.Done():
+			return nil, pc.errc
+		}
+	}
+
+	pc.wg.Add(2)
+	go pc.runPlaylistReloader(base, tracker)
+	go pc.runSegmentDownloader()
+
+	return tracks, pc.errc
+}
+
+func (pc *pullClient) fetchPlaylist(base *url.URL) (*playlist, error) {
+	req, err := http.NewRequestWithContext(pc.ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := pc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	return parsePlaylist(base, res.Body)
+}
+
+// detectTracks downloads the first segment and inspects its PMT in
+// order to find the H264 and AAC elementary streams, without emitting
+// any frame.
+func (pc *pullClient) detectTracks(segURI *url.URL) (gortsplib.Tracks, error) {
+	body, err := pc.downloadSegment(segURI)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var videoPID, audioPID uint16
+	dem := astits.NewDemuxer(pc.ctx, body, astits.DemuxerOptPacketSize(188))
+
+	for {
+		data, err := dem.NextData()
+		if err != nil {
+			if err == astits.ErrNoMorePackets {
+				break
+			}
+			return nil, err
+		}
+
+		if data.PMT == nil {
+			continue
+		}
+
+		for _, es := range data.PMT.ElementaryStreams {
+			switch es.StreamType {
+			case astits.StreamTypeH264Video:
+				videoPID = es.ElementaryPID
+			case astits.StreamTypeAACAudio:
+				audioPID = es.ElementaryPID
+			}
+		}
+		break
+	}
+
+	if videoPID == 0 && audioPID == 0 {
+		return nil, fmt.Errorf("unable to find a H264 or AAC track in the PMT")
+	}
+
+	var tracks gortsplib.Tracks
+
+	if videoPID != 0 {
+		pc.videoPID = videoPID
+		pc.videoTrack = &gortsplib.Track{ID: 0}
+		tracks = append(tracks, pc.videoTrack)
+		pc.h264Encoder = rtph264.NewEncoder(96, nil, nil)
+	}
+	if audioPID != 0 {
+		pc.audioPID = audioPID
+		pc.audioTrack = &gortsplib.Track{ID: len(tracks)}
+		tracks = append(tracks, pc.audioTrack)
+
+		sampleRate, err := pc.detectAACSampleRate(segURI, audioPID)
+		if err != nil {
+			return nil, err
+		}
+		pc.aacEncoder = rtpaac.NewEncoder(97, sampleRate, nil, nil)
+	}
+
+	return tracks, nil
+}
+
+// detectAACSampleRate re-downloads the first segment and inspects the
+// ADTS header of the first AAC frame in order to find the sample rate,
+// which is needed to initialize the RTP/AAC encoder.
+func (pc *pullClient) detectAACSampleRate(segURI *url.URL, audioPID uint16) (int, error) {
+	body, err := pc.downloadSegment(segURI)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	dem := astits.NewDemuxer(pc.ctx, body, astits.DemuxerOptPacketSize(188))
+
+	for {
+		data, err := dem.NextData()
+		if err != nil {
+			if err == astits.ErrNoMorePackets {
+				return 0, fmt.Errorf("no AAC frame found to detect sample rate")
+			}
+			return 0, err
+		}
+
+		if data.PES == nil || data.PID != audioPID {
+			continue
+		}
+
+		frames := splitADTSFrames(data.PES.Data)
+		if len(frames) == 0 {
+			continue
+		}
+
+		return frames[0].sampleRate, nil
+	}
+}
+
+func (pc *pullClient) downloadSegment(segURI *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(pc.ctx, http.MethodGet, segURI.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := pc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	return res.Body, nil
+}
+
+// runPlaylistReloader periodically re-fetches the playlist and pushes
+// newly-appeared segment URIs onto the download queue, following the
+// live sliding window.
+func (pc *pullClient) runPlaylistReloader(base *url.URL, tracker *segmentTracker) {
+	defer pc.wg.Done()
+	defer close(pc.segmentQueue)
+
+	for {
+		pl, err := pc.fetchPlaylist(base)
+		if err != nil {
+			select {
+			case pc.errc <- err:
+			default:
+			}
+			return
+		}
+
+		for _, u := range tracker.filterNew(pl) {
+			select {
+			case pc.segmentQueue <- u:
+			case <-pc.ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(targetDurationPause):
+		case <-pc.ctx.Done():
+			return
+		}
+	}
+}
+
+const targetDurationPause = 1 * time.Second
+
+// runSegmentDownloader downloads segments in order and demuxes them,
+// emitting track/payload pairs with PTS rebased against the first
+// observed PES PTS so that the produced timeline starts at zero. DTS
+// values carried by the segments are not used.
+func (pc *pullClient) runSegmentDownloader() {
+	defer pc.wg.Done()
+
+	for {
+		select {
+		case segURI, ok := <-pc.segmentQueue:
+			if !ok {
+				return
+			}
+
+			err := pc.processSegment(segURI)
+			if err != nil {
+				select {
+				case pc.errc <- err:
+				default:
+				}
+				return
+			}
+
+		case <-pc.ctx.Done():
+			return
+		}
+	}
+}
+
+func (pc *pullClient) processSegment(segURI *url.URL) error {
+	body, err := pc.downloadSegment(segURI)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dem := astits.NewDemuxer(pc.ctx, body, astits.DemuxerOptPacketSize(188))
+
+	for {
+		data, err := dem.NextData()
+		if err != nil {
+			if err == astits.ErrNoMorePackets {
+				return nil
+			}
+			return err
+		}
+
+		if data.PES == nil {
+			continue
+		}
+
+		pts := time.Duration(0)
+		if data.PES.Header.OptionalHeader != nil && data.PES.Header.OptionalHeader.PTS != nil {
+			pts = ptsToClockDuration(data.PES.Header.OptionalHeader.PTS.Base)
+		}
+
+		if !pc.clockSet {
+			pc.clockStartPTS = pts
+			pc.clockSet = true
+		}
+		pts -= pc.clockStartPTS
+
+		switch data.PID {
+		case pc.videoPID:
+			nalus := splitNALUs(data.PES.Data)
+			if len(nalus) == 0 {
+				continue
+			}
+
+			pkts, err := pc.h264Encoder.Encode(nalus, pts)
+			if err != nil {
+				return fmt.Errorf("unable to encode H264 RTP packets: %s", err)
+			}
+
+			for _, pkt := range pkts {
+				if !pc.emit(pc.videoTrack.ID, pkt) {
+					return nil
+				}
+			}
+
+		case pc.audioPID:
+			frames := splitADTSFrames(data.PES.Data)
+			if len(frames) == 0 {
+				continue
+			}
+
+			aus := make([][]byte, len(frames))
+			for i, f := range frames {
+				aus[i] = f.payload
+			}
+
+			pkts, err := pc.aacEncoder.Encode(aus, pts)
+			if err != nil {
+				return fmt.Errorf("unable to encode AAC RTP packets: %s", err)
+			}
+
+			for _, pkt := range pkts {
+				if !pc.emit(pc.audioTrack.ID, pkt) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// emit pushes a RTP packet onto the frame channel, returning false if
+// the source is shutting down.
+func (pc *pullClient) emit(trackID int, payload []byte) bool {
+	select {
+	case pc.frame <- trackIDPayloadPair{trackID, payload}:
+		return true
+	case <-pc.ctx.Done():
+		return false
+	}
+}
+
+// ptsToClockDuration converts a 33-bit MPEG-TS PTS/DTS value (90 kHz
+// clock) into a time.Duration.
+func ptsToClockDuration(pts int64) time.Duration {
+	return time.Duration(pts) * time.Second / 90000
+}
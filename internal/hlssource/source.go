@@ -0,0 +1,164 @@
+// Package hlssource contains the HLS static source.
+package hlssource
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/source"
+	"github.com/aler9/rtsp-simple-server/internal/stats"
+)
+
+const (
+	retryPause = 5 * time.Second
+)
+
+// Parent is implemented by path.Path.
+type Parent interface {
+	Log(logger.Level, string, ...interface{})
+	OnSourceStaticSetReady(req source.ExtSetReadyReq)
+	OnSourceStaticSetNotReady(req source.ExtSetNotReadyReq)
+	OnFrame(int, gortsplib.StreamType, []byte)
+}
+
+// Source is a HLS pull source.
+type Source struct {
+	ur     string
+	wg     *sync.WaitGroup
+	stats  *stats.Stats
+	parent Parent
+
+	httpClient *http.Client
+
+	ctx       context.Context
+	ctxCancel func()
+}
+
+// New allocates a Source.
+func New(
+	ctxParent context.Context,
+	ur string,
+	wg *sync.WaitGroup,
+	stats *stats.Stats,
+	parent Parent) *Source {
+	ctx, ctxCancel := context.WithCancel(ctxParent)
+
+	s := &Source{
+		ur:     ur,
+		wg:     wg,
+		stats:  stats,
+		parent: parent,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+
+	atomic.AddInt64(s.stats.CountSourcesHLS, 1)
+
+	s.log(logger.Info, "started")
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s
+}
+
+// Close closes a Source.
+func (s *Source) Close() {
+	atomic.AddInt64(s.stats.CountSourcesHLS, -1)
+	s.log(logger.Info, "stopped")
+	s.ctxCancel()
+}
+
+// IsSource implements path.source.
+func (s *Source) IsSource() {}
+
+// IsSourceStatic implements path.sourceStatic.
+func (s *Source) IsSourceStatic() {}
+
+func (s *Source) log(level logger.Level, format string, args ...interface{}) {
+	s.parent.Log(level, "[hls source] "+format, args...)
+}
+
+func (s *Source) run() {
+	defer s.wg.Done()
+
+	for {
+		ok := s.runInner()
+		if !ok {
+			break
+		}
+
+		t := time.NewTimer(retryPause)
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+func (s *Source) runInner() bool {
+	s.log(logger.Info, "connecting to '%s'", s.ur)
+
+	pc := newPullClient(s.ctx, s.ur, s.httpClient)
+
+	tracks, errc := pc.start()
+	if tracks == nil {
+		select {
+		case err := <-errc:
+			s.log(logger.Info, "ERR: %s", err)
+		case <-s.ctx.Done():
+		}
+		return s.isNotClosing()
+	}
+
+	res := make(chan struct{})
+	s.parent.OnSourceStaticSetReady(source.ExtSetReadyReq{
+		Tracks: tracks,
+		Res:    res,
+	}) //nolint:govet
+	<-res
+
+	defer func() {
+		res := make(chan struct{})
+		s.parent.OnSourceStaticSetNotReady(source.ExtSetNotReadyReq{
+			Res: res,
+		}) //nolint:govet
+		<-res
+	}()
+
+	for {
+		select {
+		case pair := <-pc.frame:
+			s.parent.OnFrame(pair.trackID, gortsplib.StreamTypeRTP, pair.payload)
+
+		case err := <-errc:
+			s.log(logger.Info, "ERR: %s", err)
+			pc.close()
+			return s.isNotClosing()
+
+		case <-s.ctx.Done():
+			pc.close()
+			return false
+		}
+	}
+}
+
+func (s *Source) isNotClosing() bool {
+	select {
+	case <-s.ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,31 @@
+// Package stats contains the counters exposed through the metrics/API subsystem.
+package stats
+
+// Stats are statistics and counters, shared across the whole program,
+// that are exposed through the metrics/API subsystem.
+type Stats struct {
+	CountClients     *int64
+	CountPublishers  *int64
+	CountReaders     *int64
+	CountSourcesRTMP *int64
+	CountSourcesHLS  *int64
+
+	// HLS-specific counters.
+	CountMuxersHLS       *int64
+	BytesSentHLS         *int64
+	SegmentsGeneratedHLS *int64
+}
+
+// New allocates a Stats.
+func New() *Stats {
+	return &Stats{
+		CountClients:         new(int64),
+		CountPublishers:      new(int64),
+		CountReaders:         new(int64),
+		CountSourcesRTMP:     new(int64),
+		CountSourcesHLS:      new(int64),
+		CountMuxersHLS:       new(int64),
+		BytesSentHLS:         new(int64),
+		SegmentsGeneratedHLS: new(int64),
+	}
+}